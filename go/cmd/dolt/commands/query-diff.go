@@ -15,7 +15,11 @@
 package commands
 
 import (
+	"container/heap"
 	"context"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/json"
 	"fmt"
 	"github.com/liquidata-inc/dolt/go/cmd/dolt/errhand"
 	"github.com/liquidata-inc/dolt/go/libraries/doltcore/diff"
@@ -34,7 +38,13 @@ import (
 	"github.com/liquidata-inc/dolt/go/store/types"
 	"github.com/liquidata-inc/go-mysql-server/sql"
 	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"vitess.io/vitess/go/sql/sqltypes"
 
 	"github.com/liquidata-inc/dolt/go/libraries/utils/filesys"
 
@@ -47,6 +57,34 @@ const (
 	toDB   = "to"
 )
 
+// resultFormat is the output format used to render the query diff.
+type resultFormat string
+
+const (
+	tabularFormat resultFormat = "tabular"
+	jsonFormat    resultFormat = "json"
+	csvFormat     resultFormat = "csv"
+	sqlFormat     resultFormat = "sql"
+)
+
+const (
+	resultFormatParam = "result-format"
+	targetTableParam  = "target-table"
+	keyParam          = "key"
+	chunkSizeParam    = "chunk-size"
+	spillDirParam     = "spill-dir"
+	inMemoryOnlyParam = "in-memory-only"
+)
+
+// defaultSortChunkBytes is the default size of an in-memory sort chunk before it's spilled to disk.
+const defaultSortChunkBytes = 64 * 1024 * 1024
+
+const (
+	diffTypeAdded    = "added"
+	diffTypeDropped  = "dropped"
+	diffTypeModified = "modified"
+)
+
 //var diffDocs = cli.CommandDocumentationContent{
 var queryDiffDocs = cli.CommandDocumentationContent{
 	ShortDesc: "",
@@ -81,6 +119,12 @@ func (cmd QueryDiffCmd) CreateMarkdown(fs filesys.Filesys, path, commandStr stri
 
 func (cmd QueryDiffCmd) createArgParser() *argparser.ArgParser {
 	ap := argparser.NewArgParser()
+	ap.SupportsString(resultFormatParam, "r", "format", "How to format the diff output. Valid values are tabular, json, csv, sql. Defaults to tabular.")
+	ap.SupportsString(targetTableParam, "", "table", "The table name to use in generated statements when --result-format=sql.")
+	ap.SupportsString(keyParam, "k", "columns", "Comma separated list of columns that uniquely identify a row, used to detect row modifications. Defaults to the primary key columns when the query selects from a single table.")
+	ap.SupportsString(chunkSizeParam, "", "bytes", "Maximum size in bytes of an in-memory sort chunk before it's spilled to disk, for queries that aren't already ordered. Defaults to 64MiB.")
+	ap.SupportsString(spillDirParam, "", "dir", "Directory to write sort spill files to. Defaults to the repository's temp table files directory.")
+	ap.SupportsFlag(inMemoryOnlyParam, "", "Never spill sort chunks to disk for unordered queries; buffer the entire result in memory instead.")
 	return ap
 }
 
@@ -107,7 +151,48 @@ func (cmd QueryDiffCmd) Exec(ctx context.Context, commandStr string, args []stri
 		return HandleVErrAndExitCode(verr, usage)
 	}
 
-	verr = diffQuery(ctx, dEnv, from, to, leftover[0])
+	format := tabularFormat
+	if formatStr, ok := apr.GetValue(resultFormatParam); ok {
+		format = resultFormat(formatStr)
+		switch format {
+		case tabularFormat, jsonFormat, csvFormat, sqlFormat:
+		default:
+			verr = errhand.BuildDError("unknown result format: %s", formatStr).Build()
+			return HandleVErrAndExitCode(verr, usage)
+		}
+	}
+
+	targetTable := apr.GetValueOrDefault(targetTableParam, "")
+	if format == sqlFormat && targetTable == "" {
+		verr = errhand.BuildDError("--%s is required when --%s=sql", targetTableParam, resultFormatParam).Build()
+		return HandleVErrAndExitCode(verr, usage)
+	}
+
+	var keyCols []string
+	if keyStr, ok := apr.GetValue(keyParam); ok {
+		keyCols = strings.Split(keyStr, ",")
+		for i := range keyCols {
+			keyCols[i] = strings.TrimSpace(keyCols[i])
+		}
+	}
+
+	chunkBytes := int64(defaultSortChunkBytes)
+	if chunkStr, ok := apr.GetValue(chunkSizeParam); ok {
+		n, perr := strconv.ParseInt(chunkStr, 10, 64)
+		if perr != nil || n <= 0 {
+			verr = errhand.BuildDError("invalid --%s: %s", chunkSizeParam, chunkStr).Build()
+			return HandleVErrAndExitCode(verr, usage)
+		}
+		chunkBytes = n
+	}
+
+	sortOpts := sortSpillOptions{
+		chunkBytes:   chunkBytes,
+		spillDir:     apr.GetValueOrDefault(spillDirParam, dEnv.TempTableFilesDir()),
+		inMemoryOnly: apr.Contains(inMemoryOnlyParam),
+	}
+
+	verr = diffQuery(ctx, dEnv, from, to, leftover[0], format, targetTable, keyCols, sortOpts)
 
 	return HandleVErrAndExitCode(verr, usage)
 }
@@ -179,7 +264,7 @@ func maybeResolve(ctx context.Context, dEnv *env.DoltEnv, spec string) (*doltdb.
 	return root, true
 }
 
-func diffQuery(ctx context.Context, dEnv *env.DoltEnv, fromRoot, toRoot *doltdb.RootValue, query string) errhand.VerboseError {
+func diffQuery(ctx context.Context, dEnv *env.DoltEnv, fromRoot, toRoot *doltdb.RootValue, query string, format resultFormat, targetTable string, declaredKeyCols []string, sortOpts sortSpillOptions) errhand.VerboseError {
 	fromCtx, fromEng, err := makeSqlEngine(ctx, dEnv, fromRoot)
 	if err != nil {
 		return errhand.VerboseErrorFromError(err)
@@ -203,21 +288,72 @@ func diffQuery(ctx context.Context, dEnv *env.DoltEnv, fromRoot, toRoot *doltdb.
 		return errhand.BuildDError("cannot diff query, result schemas are not equal").Build()
 	}
 
-	ordFromIter, ok := fromIter.(sql.OrderableRowIter)
-	if !ok {
-		return errorWithQueryPlan(ctx, dEnv, fromRoot, query)
+	keyCols := declaredKeyCols
+	if len(keyCols) == 0 {
+		keyCols = inferKeyColumns(sch)
 	}
-	ordToIter, ok := toIter.(sql.OrderableRowIter)
-	if !ok {
-		return errorWithQueryPlan(ctx, dEnv, toRoot, query)
+
+	var keyIdxs []int
+	keySch := sch
+	if len(keyCols) > 0 {
+		var err error
+		keySch, keyIdxs, err = projectSchema(sch, keyCols)
+		if err != nil {
+			return errhand.BuildDError("error resolving --%s", keyParam).AddCause(err).Build()
+		}
 	}
 
-	rowCmp, err := ordFromIter.RowCompareFunc(sch)
+	sortCmpIdxs := keyIdxs
+	if len(sortCmpIdxs) == 0 {
+		sortCmpIdxs = allColIdxs(sch)
+	}
+
+	// A query's own ORDER BY (if any) isn't guaranteed to agree with --key, so whenever a key is in play we always
+	// re-sort by it ourselves rather than trusting the engine's native row order.
+	var ordFromIter, ordToIter sql.OrderableRowIter
+	if len(keyIdxs) > 0 {
+		ordFromIter, err = newSortingRowIter(fromCtx, fromIter, sch, sortCmpIdxs, sortOpts)
+		if err != nil {
+			return errhand.BuildDError("error sorting query result at from root for diff").AddCause(err).Build()
+		}
+		ordToIter, err = newSortingRowIter(toCtx, toIter, sch, sortCmpIdxs, sortOpts)
+		if err != nil {
+			ordFromIter.Close()
+			return errhand.BuildDError("error sorting query result at to root for diff").AddCause(err).Build()
+		}
+	} else {
+		ordFromIter, err = ensureOrderable(fromCtx, fromIter, sch, sortCmpIdxs, sortOpts)
+		if err != nil {
+			return errhand.BuildDError("error sorting query result at from root for diff").AddCause(err).Build()
+		}
+		ordToIter, err = ensureOrderable(toCtx, toIter, sch, sortCmpIdxs, sortOpts)
+		if err != nil {
+			ordFromIter.Close()
+			return errhand.BuildDError("error sorting query result at to root for diff").AddCause(err).Build()
+		}
+	}
+
+	rowCmp, err := ordFromIter.RowCompareFunc(keySch)
 	if err != nil {
+		ordFromIter.Close()
+		ordToIter.Close()
 		return errorWithQueryPlan(ctx, dEnv, fromRoot, query)
 	}
 
-	doltSch := doltSchFromSqlSchema(sch)
+	if format != tabularFormat {
+		qd := &queryDiffer{
+			sqlCtx:   fromCtx,
+			fromIter: ordFromIter,
+			toIter:   ordToIter,
+			rowCmp:   rowCmp,
+			sch:      sch,
+			keyIdxs:  keyIdxs,
+		}
+
+		return writeFormattedDiff(qd, sch, format, targetTable)
+	}
+
+	doltSch := doltSchFromSqlSchema(sch, keyCols)
 
 	joiner, err := rowconv.NewJoiner(
 		[]rowconv.NamedSchema{
@@ -237,6 +373,7 @@ func diffQuery(ctx context.Context, dEnv *env.DoltEnv, fromRoot, toRoot *doltdb.
 		rowCmp:   rowCmp,
 		sch:      sch,
 		joiner:   joiner,
+		keyIdxs:  keyIdxs,
 	}
 
 	p, err := buildQueryDiffPipeline(qd, doltSch)
@@ -270,12 +407,65 @@ func makeSqlEngine(ctx context.Context, dEnv *env.DoltEnv, root *doltdb.RootValu
 	return sqlCtx, eng, nil
 }
 
-func doltSchFromSqlSchema(sch sql.Schema) schema.Schema {
+// inferKeyColumns returns the primary key columns of sch when every column in sch comes from the same table, so that
+// a --key can be inferred without the user declaring one. It returns nil when the query joins multiple tables or
+// the source table has no declared primary key, since the result can't be safely keyed in that case.
+func inferKeyColumns(sch sql.Schema) []string {
+	if len(sch) == 0 {
+		return nil
+	}
+
+	source := sch[0].Source
+	var keyCols []string
+	for _, col := range sch {
+		if col.Source != source {
+			return nil
+		}
+		if col.PrimaryKey {
+			keyCols = append(keyCols, col.Name)
+		}
+	}
+
+	return keyCols
+}
+
+// projectSchema resolves colNames against sch, returning the sub-schema and the indexes of those columns within sch,
+// in the same order as colNames.
+func projectSchema(sch sql.Schema, colNames []string) (sql.Schema, []int, error) {
+	idxByName := make(map[string]int, len(sch))
+	for i, col := range sch {
+		idxByName[strings.ToLower(col.Name)] = i
+	}
+
+	idxs := make([]int, len(colNames))
+	keySch := make(sql.Schema, len(colNames))
+	for i, name := range colNames {
+		idx, ok := idxByName[strings.ToLower(name)]
+		if !ok {
+			return nil, nil, fmt.Errorf("key column %s not found in query result", name)
+		}
+		idxs[i] = idx
+		keySch[i] = sch[idx]
+	}
+
+	return keySch, idxs, nil
+}
+
+// doltSchFromSqlSchema converts sch to a dolt schema, marking keyCols as the primary key. When keyCols is empty the
+// first column is promoted to the primary key instead, matching the behavior of a query_diff run without --key.
+func doltSchFromSqlSchema(sch sql.Schema, keyCols []string) schema.Schema {
 	dSch, _ := sqle.SqlSchemaToDoltResultSchema(sch)
-	// make the first col the PK
+
+	keySet := make(map[string]bool, len(keyCols))
+	for _, name := range keyCols {
+		keySet[strings.ToLower(name)] = true
+	}
+
 	pk := false
 	newCC, _ := schema.MapColCollection(dSch.GetAllCols(), func(col schema.Column) (column schema.Column, err error) {
-		if !pk {
+		if len(keySet) > 0 {
+			col.IsPartOfPK = keySet[strings.ToLower(col.Name)]
+		} else if !pk {
 			col.IsPartOfPK = true
 			pk = true
 		}
@@ -311,6 +501,771 @@ func errorWithQueryPlan(ctx context.Context, dEnv *env.DoltEnv, root *doltdb.Roo
 	return errhand.BuildDError("Cannot diff query, query is not ordered. Add ORDER BY statement.\nquery plan:\n%s", qp.String()).Build()
 }
 
+// sortSpillOptions configures sortingRowIter, the fallback used to make an unordered query result consumable by
+// queryDiffer.
+type sortSpillOptions struct {
+	// chunkBytes is the approximate size, in bytes, that an in-memory sort chunk is allowed to grow to before it's
+	// sorted and spilled to disk.
+	chunkBytes int64
+	// spillDir is the directory sorted chunks are written to.
+	spillDir string
+	// inMemoryOnly disables spilling entirely: the whole result is buffered and sorted in memory as a single chunk.
+	inMemoryOnly bool
+}
+
+// allColIdxs returns the indexes 0..len(sch)-1, used as the sort/compare projection when no --key is known.
+func allColIdxs(sch sql.Schema) []int {
+	idxs := make([]int, len(sch))
+	for i := range sch {
+		idxs[i] = i
+	}
+	return idxs
+}
+
+// ensureOrderable returns iter unchanged if it already reports an ordering, otherwise it wraps iter in a
+// sortingRowIter that establishes one by sorting cmpIdxs, spilling to disk as configured by opts.
+func ensureOrderable(sqlCtx *sql.Context, iter sql.RowIter, sch sql.Schema, cmpIdxs []int, opts sortSpillOptions) (sql.OrderableRowIter, error) {
+	if ordIter, ok := iter.(sql.OrderableRowIter); ok {
+		return ordIter, nil
+	}
+
+	return newSortingRowIter(sqlCtx, iter, sch, cmpIdxs, opts)
+}
+
+// compareSQLValues compares two column values of type t, treating NULL as sorting before any non-NULL value. It
+// falls back to lexical comparison of the values' string representation when t doesn't support comparison.
+func compareSQLValues(t sql.Type, a, b interface{}) (int, error) {
+	if a == nil && b == nil {
+		return 0, nil
+	} else if a == nil {
+		return -1, nil
+	} else if b == nil {
+		return 1, nil
+	}
+
+	if cmp, err := t.Compare(a, b); err == nil {
+		return cmp, nil
+	}
+
+	as, bs := fmt.Sprint(a), fmt.Sprint(b)
+	switch {
+	case as < bs:
+		return -1, nil
+	case as > bs:
+		return 1, nil
+	default:
+		return 0, nil
+	}
+}
+
+// buildRowComparator returns a comparator that orders rows by the columns of sch at idxs, in order.
+func buildRowComparator(sch sql.Schema, idxs []int) sql.RowCompareFunc {
+	return func(_ *sql.Context, a, b sql.Row) (int, error) {
+		for _, idx := range idxs {
+			cmp, err := compareSQLValues(sch[idx].Type, a[idx], b[idx])
+			if err != nil {
+				return 0, err
+			}
+			if cmp != 0 {
+				return cmp, nil
+			}
+		}
+		return 0, nil
+	}
+}
+
+// buildFullRowComparator returns a comparator that orders rows by the columns of sch at idxs, in order, then breaks
+// ties with every other column of sch (in schema order). It's used to give sortingRowIter a deterministic, total
+// order for chunk sorting and merging: ordering by idxs (the --key columns) alone leaves rows that share a key in
+// whatever arbitrary order an unstable sort left them in, so a from/to pair sharing a duplicate key can end up
+// merged out of step and reported as a spurious modification even when the two sides hold the same rows.
+func buildFullRowComparator(sch sql.Schema, idxs []int) sql.RowCompareFunc {
+	inIdxs := make(map[int]bool, len(idxs))
+	for _, idx := range idxs {
+		inIdxs[idx] = true
+	}
+
+	tiebreakIdxs := make([]int, 0, len(sch))
+	for i := range sch {
+		if !inIdxs[i] {
+			tiebreakIdxs = append(tiebreakIdxs, i)
+		}
+	}
+
+	keyCmp := buildRowComparator(sch, idxs)
+	tiebreakCmp := buildRowComparator(sch, tiebreakIdxs)
+
+	return func(sqlCtx *sql.Context, a, b sql.Row) (int, error) {
+		cmp, err := keyCmp(sqlCtx, a, b)
+		if err != nil || cmp != 0 {
+			return cmp, err
+		}
+		return tiebreakCmp(sqlCtx, a, b)
+	}
+}
+
+// estimateRowSize approximates the in-memory footprint of a row's values, used to decide when an in-memory sort
+// chunk should be spilled.
+func estimateRowSize(r sql.Row) int64 {
+	var n int64
+	for _, v := range r {
+		switch t := v.(type) {
+		case nil:
+			n++
+		case string:
+			n += int64(len(t))
+		case []byte:
+			n += int64(len(t))
+		default:
+			n += 8
+		}
+	}
+	return n
+}
+
+// rowSource is one sorted stream of rows being merged by a chunkMerger: either an in-memory chunk or a spilled one
+// being read back off disk.
+type rowSource interface {
+	next() (sql.Row, error)
+	close() error
+}
+
+type sliceRowSource struct {
+	rows []sql.Row
+	pos  int
+}
+
+func (s *sliceRowSource) next() (sql.Row, error) {
+	if s.pos >= len(s.rows) {
+		return nil, io.EOF
+	}
+	r := s.rows[s.pos]
+	s.pos++
+	return r, nil
+}
+
+func (s *sliceRowSource) close() error {
+	return nil
+}
+
+// valueKind identifies which field of encodedValue a row value was encoded into.
+type valueKind byte
+
+const (
+	kindNull valueKind = iota
+	kindInt64
+	kindUint64
+	kindFloat64
+	kindString
+	kindBytes
+	kindBool
+	kindTime
+)
+
+// encodedValue is the on-disk encoding of a single sql.Row value. It's gob-encodable without registration because
+// every field is a concrete type, never an interface{} — the thing that made the original encoding break on any
+// value whose concrete Go type wasn't among a handful of registered ones.
+//
+// A value is funneled into the kind that matches its Go type (widening integers/floats to the widest of their
+// signedness), and reconstructed on decode via the owning column's sql.Type.Convert, so the decoded value always
+// comes back as whatever concrete type that sql.Type would itself produce - not necessarily the exact Go type that
+// was encoded.
+type encodedValue struct {
+	Kind valueKind
+	I    int64
+	U    uint64
+	F    float64
+	S    string
+	B    []byte
+	Bl   bool
+	T    time.Time
+}
+
+// encodeValue maps a sql.Row value into its on-disk representation. NULLs round-trip explicitly via kindNull, so
+// unlike gob-encoding v directly, a nil value never fails to encode. Types with no dedicated kind (e.g.
+// decimal.Decimal, JSON documents) fall back to their string representation, and are restored to their native
+// type by decodeValue via the column's sql.Type.
+func encodeValue(v interface{}) encodedValue {
+	switch t := v.(type) {
+	case nil:
+		return encodedValue{Kind: kindNull}
+	case int:
+		return encodedValue{Kind: kindInt64, I: int64(t)}
+	case int8:
+		return encodedValue{Kind: kindInt64, I: int64(t)}
+	case int16:
+		return encodedValue{Kind: kindInt64, I: int64(t)}
+	case int32:
+		return encodedValue{Kind: kindInt64, I: int64(t)}
+	case int64:
+		return encodedValue{Kind: kindInt64, I: t}
+	case uint:
+		return encodedValue{Kind: kindUint64, U: uint64(t)}
+	case uint8:
+		return encodedValue{Kind: kindUint64, U: uint64(t)}
+	case uint16:
+		return encodedValue{Kind: kindUint64, U: uint64(t)}
+	case uint32:
+		return encodedValue{Kind: kindUint64, U: uint64(t)}
+	case uint64:
+		return encodedValue{Kind: kindUint64, U: t}
+	case float32:
+		return encodedValue{Kind: kindFloat64, F: float64(t)}
+	case float64:
+		return encodedValue{Kind: kindFloat64, F: t}
+	case bool:
+		return encodedValue{Kind: kindBool, Bl: t}
+	case []byte:
+		return encodedValue{Kind: kindBytes, B: t}
+	case time.Time:
+		return encodedValue{Kind: kindTime, T: t}
+	case string:
+		return encodedValue{Kind: kindString, S: t}
+	default:
+		return encodedValue{Kind: kindString, S: fmt.Sprint(t)}
+	}
+}
+
+// decodeValue restores a value encoded by encodeValue, converting it back to its column's own type via t.Convert.
+func decodeValue(ev encodedValue, t sql.Type) (interface{}, error) {
+	switch ev.Kind {
+	case kindNull:
+		return nil, nil
+	case kindInt64:
+		return t.Convert(ev.I)
+	case kindUint64:
+		return t.Convert(ev.U)
+	case kindFloat64:
+		return t.Convert(ev.F)
+	case kindString:
+		return t.Convert(ev.S)
+	case kindBytes:
+		return t.Convert(ev.B)
+	case kindBool:
+		return t.Convert(ev.Bl)
+	case kindTime:
+		return t.Convert(ev.T)
+	default:
+		return nil, fmt.Errorf("unknown encoded value kind: %d", ev.Kind)
+	}
+}
+
+// fileRowSource reads back a chunk of rows spilled to disk by spillChunk, encoded in the same order they were
+// written.
+type fileRowSource struct {
+	f   *os.File
+	dec *gob.Decoder
+	sch sql.Schema
+}
+
+func openFileRowSource(path string, sch sql.Schema) (*fileRowSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileRowSource{f: f, dec: gob.NewDecoder(f), sch: sch}, nil
+}
+
+func (s *fileRowSource) next() (sql.Row, error) {
+	var encRow []encodedValue
+	if err := s.dec.Decode(&encRow); err != nil {
+		return nil, err
+	}
+
+	row := make(sql.Row, len(encRow))
+	for i, ev := range encRow {
+		v, err := decodeValue(ev, s.sch[i].Type)
+		if err != nil {
+			return nil, err
+		}
+		row[i] = v
+	}
+	return row, nil
+}
+
+func (s *fileRowSource) close() error {
+	return s.f.Close()
+}
+
+// spillChunk writes a sorted chunk of rows to a new temp file under dir, returning its path. Values are encoded via
+// encodeValue rather than gob-over-interface{}, so NULLs and any sql.Type's concrete value round-trip without
+// requiring every possible concrete type to be gob-registered up front.
+func spillChunk(dir string, sch sql.Schema, rows []sql.Row) (string, error) {
+	f, err := ioutil.TempFile(dir, "query_diff_sort_chunk_*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	enc := gob.NewEncoder(f)
+	for _, r := range rows {
+		encRow := make([]encodedValue, len(r))
+		for i, v := range r {
+			encRow[i] = encodeValue(v)
+		}
+		if err := enc.Encode(encRow); err != nil {
+			return "", err
+		}
+	}
+
+	return f.Name(), nil
+}
+
+// mergeHeapItem is an entry in chunkMerger's min-heap: the next unconsumed row from one of its sources.
+type mergeHeapItem struct {
+	row    sql.Row
+	srcIdx int
+}
+
+// chunkMerger performs a k-way merge of already-sorted rowSources into a single sorted stream.
+type chunkMerger struct {
+	sqlCtx  *sql.Context
+	rowCmp  sql.RowCompareFunc
+	sources []rowSource
+	items   []mergeHeapItem
+}
+
+func newChunkMerger(sqlCtx *sql.Context, rowCmp sql.RowCompareFunc, sources []rowSource) (*chunkMerger, error) {
+	m := &chunkMerger{sqlCtx: sqlCtx, rowCmp: rowCmp, sources: sources}
+
+	for i, src := range sources {
+		r, err := src.next()
+		if err == io.EOF {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		heap.Push(m, mergeHeapItem{row: r, srcIdx: i})
+	}
+
+	return m, nil
+}
+
+func (m *chunkMerger) Len() int { return len(m.items) }
+
+func (m *chunkMerger) Less(i, j int) bool {
+	cmp, _ := m.rowCmp(m.sqlCtx, m.items[i].row, m.items[j].row)
+	return cmp < 0
+}
+
+func (m *chunkMerger) Swap(i, j int) { m.items[i], m.items[j] = m.items[j], m.items[i] }
+
+func (m *chunkMerger) Push(x interface{}) { m.items = append(m.items, x.(mergeHeapItem)) }
+
+func (m *chunkMerger) Pop() interface{} {
+	old := m.items
+	n := len(old)
+	item := old[n-1]
+	m.items = old[:n-1]
+	return item
+}
+
+func (m *chunkMerger) Next() (sql.Row, error) {
+	if len(m.items) == 0 {
+		return nil, io.EOF
+	}
+
+	top := heap.Pop(m).(mergeHeapItem)
+
+	next, err := m.sources[top.srcIdx].next()
+	if err == nil {
+		heap.Push(m, mergeHeapItem{row: next, srcIdx: top.srcIdx})
+	} else if err != io.EOF {
+		return nil, err
+	}
+
+	return top.row, nil
+}
+
+func (m *chunkMerger) Close() error {
+	var firstErr error
+	for _, src := range m.sources {
+		if err := src.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// sortingRowIter adapts an unordered sql.RowIter into a sql.OrderableRowIter by buffering its rows into fixed-size
+// chunks, sorting each chunk in memory, spilling sorted chunks to disk (unless opts.inMemoryOnly is set), and
+// streaming a k-way merge of the chunks back out.
+type sortingRowIter struct {
+	rowCmp     sql.RowCompareFunc
+	chunkFiles []string
+	merger     *chunkMerger
+}
+
+func newSortingRowIter(sqlCtx *sql.Context, src sql.RowIter, sch sql.Schema, cmpIdxs []int, opts sortSpillOptions) (result *sortingRowIter, err error) {
+	// rowCmp, exposed via RowCompareFunc, compares only cmpIdxs so queryDiffer can tell whether two rows share a
+	// key. sortCmp additionally breaks ties on every other column, so chunk sorting and merging produce a
+	// deterministic order even when cmpIdxs doesn't uniquely identify a row.
+	rowCmp := buildRowComparator(sch, cmpIdxs)
+	sortCmp := buildFullRowComparator(sch, cmpIdxs)
+
+	it := &sortingRowIter{rowCmp: rowCmp}
+
+	var memChunks [][]sql.Row
+	var sources []rowSource
+
+	// If construction fails after one or more chunks have already been spilled, there's no sortingRowIter for the
+	// caller to Close, so any opened sources and spilled chunk files must be cleaned up here instead of leaking.
+	defer func() {
+		if err != nil {
+			for _, s := range sources {
+				s.close()
+			}
+			for _, path := range it.chunkFiles {
+				os.Remove(path)
+			}
+		}
+	}()
+
+	var chunk []sql.Row
+	var chunkBytes int64
+
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+
+		sort.Slice(chunk, func(i, j int) bool {
+			cmp, _ := sortCmp(sqlCtx, chunk[i], chunk[j])
+			return cmp < 0
+		})
+
+		if opts.inMemoryOnly {
+			memChunks = append(memChunks, chunk)
+		} else {
+			path, serr := spillChunk(opts.spillDir, sch, chunk)
+			if serr != nil {
+				return serr
+			}
+			it.chunkFiles = append(it.chunkFiles, path)
+		}
+
+		chunk = nil
+		chunkBytes = 0
+		return nil
+	}
+
+	for {
+		r, nerr := src.Next()
+		if nerr == io.EOF {
+			break
+		} else if nerr != nil {
+			return nil, nerr
+		}
+
+		chunk = append(chunk, r)
+		chunkBytes += estimateRowSize(r)
+		if !opts.inMemoryOnly && chunkBytes >= opts.chunkBytes {
+			if ferr := flush(); ferr != nil {
+				return nil, ferr
+			}
+		}
+	}
+	if ferr := flush(); ferr != nil {
+		return nil, ferr
+	}
+
+	if cerr := src.Close(); cerr != nil {
+		return nil, cerr
+	}
+
+	sources = make([]rowSource, 0, len(it.chunkFiles)+len(memChunks))
+	for _, path := range it.chunkFiles {
+		fs, oerr := openFileRowSource(path, sch)
+		if oerr != nil {
+			return nil, oerr
+		}
+		sources = append(sources, fs)
+	}
+	for _, rows := range memChunks {
+		sources = append(sources, &sliceRowSource{rows: rows})
+	}
+
+	merger, merr := newChunkMerger(sqlCtx, sortCmp, sources)
+	if merr != nil {
+		return nil, merr
+	}
+	it.merger = merger
+
+	return it, nil
+}
+
+func (it *sortingRowIter) Next() (sql.Row, error) {
+	return it.merger.Next()
+}
+
+func (it *sortingRowIter) Close() error {
+	mergeErr := it.merger.Close()
+
+	for _, path := range it.chunkFiles {
+		if err := os.Remove(path); err != nil && mergeErr == nil {
+			mergeErr = err
+		}
+	}
+
+	return mergeErr
+}
+
+func (it *sortingRowIter) RowCompareFunc(sql.Schema) (sql.RowCompareFunc, error) {
+	return it.rowCmp, nil
+}
+
+// diffRowWriter renders a single from/to row pair produced by queryDiffer in a particular result format. Exactly one
+// of from or to may be nil, indicating a dropped or added row respectively.
+type diffRowWriter interface {
+	WriteDiff(from, to sql.Row) error
+	Close() error
+}
+
+// writeFormattedDiff drives qd to completion, writing each diff row out in the given non-tabular format. Tabular
+// output goes through buildQueryDiffPipeline instead, since it relies on the fixed-width and color transforms.
+func writeFormattedDiff(qd *queryDiffer, sch sql.Schema, format resultFormat, targetTable string) errhand.VerboseError {
+	defer func() {
+		if err := qd.fromIter.Close(); err != nil {
+			cli.PrintErrln(err)
+		}
+		if err := qd.toIter.Close(); err != nil {
+			cli.PrintErrln(err)
+		}
+	}()
+
+	var w diffRowWriter
+	switch format {
+	case jsonFormat:
+		w = newJSONDiffWriter(cli.CliOut, sch)
+	case csvFormat:
+		w = newCSVDiffWriter(cli.CliOut, sch)
+	case sqlFormat:
+		w = newSQLDiffWriter(cli.CliOut, sch, targetTable)
+	default:
+		return errhand.BuildDError("unsupported result format: %s", format).Build()
+	}
+
+	for {
+		fromRow, toRow, err := qd.nextDiff()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errhand.VerboseErrorFromError(err)
+		}
+
+		if err := w.WriteDiff(fromRow, toRow); err != nil {
+			return errhand.VerboseErrorFromError(err)
+		}
+	}
+
+	return errhand.VerboseErrorFromError(w.Close())
+}
+
+func classifyDiff(from, to sql.Row) string {
+	switch {
+	case from == nil:
+		return diffTypeAdded
+	case to == nil:
+		return diffTypeDropped
+	default:
+		return diffTypeModified
+	}
+}
+
+func sqlRowToMap(sch sql.Schema, r sql.Row) map[string]interface{} {
+	m := make(map[string]interface{}, len(sch))
+	for i, col := range sch {
+		m[col.Name] = r[i]
+	}
+	return m
+}
+
+// jsonDiffWriter writes one JSON object per diff row, each with a diff_type field and from/to sub-objects for
+// whichever sides are present. Output is newline-delimited JSON so it can be streamed into downstream tooling.
+type jsonDiffWriter struct {
+	sch sql.Schema
+	enc *json.Encoder
+}
+
+func newJSONDiffWriter(w io.Writer, sch sql.Schema) *jsonDiffWriter {
+	return &jsonDiffWriter{sch: sch, enc: json.NewEncoder(w)}
+}
+
+func (w *jsonDiffWriter) WriteDiff(from, to sql.Row) error {
+	obj := map[string]interface{}{"diff_type": classifyDiff(from, to)}
+	if from != nil {
+		obj["from"] = sqlRowToMap(w.sch, from)
+	}
+	if to != nil {
+		obj["to"] = sqlRowToMap(w.sch, to)
+	}
+
+	return w.enc.Encode(obj)
+}
+
+func (w *jsonDiffWriter) Close() error {
+	return nil
+}
+
+// csvDiffWriter writes one CSV row per side of a diff, prefixed with "-" for the from side and "+" for the to side.
+type csvDiffWriter struct {
+	wr *csv.Writer
+}
+
+func newCSVDiffWriter(w io.Writer, sch sql.Schema) *csvDiffWriter {
+	cw := csv.NewWriter(w)
+
+	header := make([]string, 0, len(sch)+1)
+	header = append(header, "diff")
+	for _, col := range sch {
+		header = append(header, col.Name)
+	}
+	cw.Write(header)
+
+	return &csvDiffWriter{wr: cw}
+}
+
+func (w *csvDiffWriter) WriteDiff(from, to sql.Row) error {
+	if from != nil {
+		if err := w.writeRow("-", from); err != nil {
+			return err
+		}
+	}
+	if to != nil {
+		if err := w.writeRow("+", to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *csvDiffWriter) writeRow(prefix string, r sql.Row) error {
+	rec := make([]string, 0, len(r)+1)
+	rec = append(rec, prefix)
+	for _, v := range r {
+		rec = append(rec, fmt.Sprint(v))
+	}
+	return w.wr.Write(rec)
+}
+
+func (w *csvDiffWriter) Close() error {
+	w.wr.Flush()
+	return w.wr.Error()
+}
+
+// sqlDiffWriter renders each diff row as INSERT or DELETE statements against targetTable, quoting values according
+// to the SQL schema of the diffed query. A modified row is written as a DELETE of the old row followed by an INSERT
+// of the new one; no UPDATE statements are generated. Rows that are equal on both sides produce no statement.
+type sqlDiffWriter struct {
+	wr          io.Writer
+	sch         sql.Schema
+	targetTable string
+}
+
+func newSQLDiffWriter(w io.Writer, sch sql.Schema, targetTable string) *sqlDiffWriter {
+	return &sqlDiffWriter{wr: w, sch: sch, targetTable: targetTable}
+}
+
+func (w *sqlDiffWriter) WriteDiff(from, to sql.Row) error {
+	switch {
+	case from == nil:
+		return w.writeInsert(to)
+	case to == nil:
+		return w.writeDelete(from)
+	default:
+		eq, err := w.rowsEqual(from, to)
+		if err != nil {
+			return err
+		}
+		if eq {
+			return nil
+		}
+
+		if err := w.writeDelete(from); err != nil {
+			return err
+		}
+		return w.writeInsert(to)
+	}
+}
+
+func (w *sqlDiffWriter) writeInsert(r sql.Row) error {
+	cols := make([]string, len(w.sch))
+	vals := make([]string, len(w.sch))
+	for i, col := range w.sch {
+		cols[i] = sqlQuoteIdent(col.Name)
+		vals[i] = sqlQuoteValue(col.Type, r[i])
+	}
+
+	_, err := fmt.Fprintf(w.wr, "INSERT INTO %s (%s) VALUES (%s);\n", sqlQuoteIdent(w.targetTable), strings.Join(cols, ", "), strings.Join(vals, ", "))
+	return err
+}
+
+func (w *sqlDiffWriter) writeDelete(r sql.Row) error {
+	preds := make([]string, len(w.sch))
+	for i, col := range w.sch {
+		preds[i] = fmt.Sprintf("%s = %s", sqlQuoteIdent(col.Name), sqlQuoteValue(col.Type, r[i]))
+	}
+
+	_, err := fmt.Fprintf(w.wr, "DELETE FROM %s WHERE %s;\n", sqlQuoteIdent(w.targetTable), strings.Join(preds, " AND "))
+	return err
+}
+
+// rowsEqual reports whether from and to hold the same values in every column, comparing each via its sql.Type
+// rather than Go equality so uncomparable dynamic types (e.g. []byte for BLOB/JSON columns) don't panic.
+func (w *sqlDiffWriter) rowsEqual(from, to sql.Row) (bool, error) {
+	for i, col := range w.sch {
+		cmp, err := compareSQLValues(col.Type, from[i], to[i])
+		if err != nil {
+			return false, err
+		}
+		if cmp != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (w *sqlDiffWriter) Close() error {
+	return nil
+}
+
+// sqlQuoteIdent backtick-quotes a SQL identifier (column or table name), doubling any embedded backtick, so a name
+// that collides with a reserved word (e.g. a column named order) still produces valid SQL.
+func sqlQuoteIdent(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+func sqlQuoteValue(t sql.Type, v interface{}) string {
+	if v == nil {
+		return "NULL"
+	}
+
+	switch t.Type() {
+	case sqltypes.Int8, sqltypes.Int16, sqltypes.Int24, sqltypes.Int32, sqltypes.Int64,
+		sqltypes.Uint8, sqltypes.Uint16, sqltypes.Uint24, sqltypes.Uint32, sqltypes.Uint64,
+		sqltypes.Float32, sqltypes.Float64, sqltypes.Decimal:
+		return fmt.Sprint(v)
+	case sqltypes.Date:
+		if tm, ok := v.(time.Time); ok {
+			return fmt.Sprintf("'%s'", tm.Format("2006-01-02"))
+		}
+		return fmt.Sprintf("'%s'", strings.ReplaceAll(fmt.Sprint(v), "'", "''"))
+	case sqltypes.Datetime, sqltypes.Timestamp:
+		if tm, ok := v.(time.Time); ok {
+			return fmt.Sprintf("'%s'", tm.Format("2006-01-02 15:04:05"))
+		}
+		return fmt.Sprintf("'%s'", strings.ReplaceAll(fmt.Sprint(v), "'", "''"))
+	case sqltypes.Time:
+		if tm, ok := v.(time.Time); ok {
+			return fmt.Sprintf("'%s'", tm.Format("15:04:05"))
+		}
+		return fmt.Sprintf("'%s'", strings.ReplaceAll(fmt.Sprint(v), "'", "''"))
+	default:
+		return fmt.Sprintf("'%s'", strings.ReplaceAll(fmt.Sprint(v), "'", "''"))
+	}
+}
+
 type queryDiffer struct {
 	sqlCtx   *sql.Context
 	fromIter sql.RowIter
@@ -320,6 +1275,10 @@ type queryDiffer struct {
 	rowCmp	 sql.RowCompareFunc
 	sch      sql.Schema
 	joiner   *rowconv.Joiner
+	// keyIdxs are the indexes into sch of the declared (or inferred) key columns, used to distinguish a row
+	// modification from a drop/add when rowCmp reports the key as equal. Nil when no key is known, in which case
+	// an equally-keyed but unequal row pair can't be told apart from a drop/add.
+	keyIdxs []int
 }
 
 func (qd *queryDiffer) nextDiff() (sql.Row, sql.Row, error) {
@@ -375,9 +1334,17 @@ func (qd *queryDiffer) nextDiff() (sql.Row, sql.Row, error) {
 				qd.fromRow = nil
 				qd.toRow = nil
 				continue
+			} else if qd.keyIdxs != nil {
+				// the key matches but the row isn't, so this is a modification: hand back both sides joined
+				// together rather than a drop/add pair
+				fromRow := qd.fromRow
+				toRow := qd.toRow
+				qd.fromRow = nil
+				qd.toRow = nil
+				return fromRow, toRow, nil
 			} else {
-				// todo: we don't have any way to detect updates at this point
-				// if rows are ordered equally, but not equal in value, consider it a drop/add
+				// no key was declared or could be inferred, so we can't tell an update apart from a drop/add;
+				// treat the from-row as a drop, keeping the to-row to compare against the next from-row
 				fromRow := qd.fromRow
 				qd.fromRow = nil
 				return fromRow, nil, nil
@@ -459,6 +1426,17 @@ func buildQueryDiffPipeline(qd *queryDiffer, doltSch schema.Schema) (*pipeline.P
 		}
 	})
 
+	// qd.fromIter/qd.toIter may be backed by a sortingRowIter spilling to temp files; make sure those get cleaned
+	// up once the pipeline is done, whether it succeeded or errored out.
+	p.RunAfter(func() {
+		if err := qd.fromIter.Close(); err != nil {
+			cli.PrintErrln(err)
+		}
+		if err := qd.toIter.Close(); err != nil {
+			cli.PrintErrln(err)
+		}
+	})
+
 	names := make(map[uint64]string, doltSch.GetAllCols().Size())
 	_ = doltSch.GetAllCols().Iter(func(tag uint64, col schema.Column) (stop bool, err error) {
 		names[tag] = col.Name